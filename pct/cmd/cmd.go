@@ -18,17 +18,39 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/percona/qan-agent/pct/cmd/metrics"
 )
 
 var (
 	DefaultTimeout = 60 * time.Second
+
+	// KillGracePeriod is how long RunContext waits after sending SIGTERM to
+	// the process group before it escalates to SIGKILL.
+	KillGracePeriod = 100 * time.Millisecond
+
+	// KillConfirmTimeout bounds how long killProcessGroup waits for the
+	// killed process to actually be reaped after a signal was sent
+	// successfully. Normally that's near-instant, but a stage piped into a
+	// downstream stage that failed before consuming its stdin can otherwise
+	// block forever inside cmd.Wait(), which waits for its stdout-copying
+	// goroutine to finish writing into what's now a dead-end pipe. This
+	// bounds that wait instead of hanging RunContext permanently.
+	KillConfirmTimeout = 30 * time.Second
 )
 
 var (
@@ -37,13 +59,58 @@ var (
 	ErrKillProcessAfterTimeout = errors.New("Failed to kill process after timeout")
 )
 
+// Result is what running a Cmd produces: stdout and stderr captured
+// separately (each capped at MaxOutputBytes, if set), the process's exit
+// code, and how long it ran.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
 // Wrap os/exec/Cmd so we can test commands.
 type Cmd interface {
-	Run() (output string, err error)
+	Run() (Result, error)
+
+	// RunContext is like Run, but the command is terminated when ctx is
+	// done. Termination is graceful: the process group is sent SIGTERM
+	// first, then SIGKILL if it hasn't exited after KillGracePeriod.
+	RunContext(ctx context.Context) (Result, error)
 }
 
 type CmdFactory interface {
 	Make(name string, args ...string) Cmd
+
+	// MakeContext is like Make, but the returned Cmd is run via
+	// RunContext instead of Run.
+	MakeContext(ctx context.Context, name string, args ...string) Cmd
+
+	// MakePipeline wires cmds into a single Cmd: stage N's stdout becomes
+	// stage N+1's stdin, like a shell pipeline but without a shell.
+	// Running the result runs every stage concurrently and returns the
+	// last stage's Result.
+	MakePipeline(cmds ...Cmd) Cmd
+
+	// Register constrains how name is resolved: once registered, every
+	// Cmd for name must resolve (via $PATH, like exec.LookPath) to a path
+	// satisfying opts, or it's refused instead of run.
+	Register(name string, opts BinaryOpts)
+}
+
+// BinaryOpts constrains how Factory.Register validates a binary once it's
+// been resolved on $PATH, so the agent doesn't run an unexpected binary
+// (e.g. a decoy pt-summary) that happens to sit earlier in $PATH.
+type BinaryOpts struct {
+	// AllowedPaths restricts the binary to these exact resolved paths.
+	// Empty means any path LookPath resolves to is accepted.
+	AllowedPaths []string
+	// MinVersion is the lowest acceptable version, parsed out of the
+	// binary's "--version" output, e.g. "3.0.2".
+	MinVersion string
+	// Capabilities are substrings required in the binary's "--help"
+	// output, e.g. features the caller depends on.
+	Capabilities []string
 }
 
 // Set in main/percona-agent/main.go to RealCmdFactory for real agent,
@@ -53,24 +120,391 @@ var Factory CmdFactory
 // --------------------------------------------------------------------------
 
 type RealCmdFactory struct {
+	mu         sync.Mutex
+	registered map[string]BinaryOpts
+	resolved   map[string]string // binary name -> resolved absolute path
 }
 
 func (f *RealCmdFactory) Make(name string, args ...string) Cmd {
-	return NewRealCmd(name, args...)
+	cmd := newRealCmd(name, args...)
+	cmd.factory = f
+	return cmd
+}
+
+func (f *RealCmdFactory) MakeContext(ctx context.Context, name string, args ...string) Cmd {
+	cmd := newRealCmd(name, args...)
+	cmd.factory = f
+	cmd.ctx = ctx
+	return cmd
+}
+
+func (f *RealCmdFactory) MakePipeline(cmds ...Cmd) Cmd {
+	stages := make([]*RealCmd, len(cmds))
+	for i, c := range cmds {
+		rc, ok := c.(*RealCmd)
+		if !ok {
+			// Piping is implemented with os/exec-level io.Pipe plumbing
+			// between stages, which only a *RealCmd exposes, so a mock
+			// Cmd (substituted in tests) can't participate. Report that
+			// as a normal run error instead of panicking on an
+			// otherwise valid Cmd value.
+			return &erroringCmd{err: fmt.Errorf("MakePipeline: stage %d is %T, not *RealCmd; only Cmds made by RealCmdFactory can be piped", i, c)}
+		}
+		stages[i] = rc
+	}
+	return &pipelineCmd{stages: stages}
+}
+
+func (f *RealCmdFactory) Register(name string, opts BinaryOpts) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.registered == nil {
+		f.registered = make(map[string]BinaryOpts)
+	}
+	f.registered[name] = opts
+	delete(f.resolved, name) // re-validate against the new opts next resolve
+}
+
+// resolve finds name on $PATH, validating it against any BinaryOpts
+// registered for it, and caches the result so repeated invocations of the
+// same binary (e.g. pt-summary run every interval) don't re-stat $PATH or
+// re-probe --version each time. The --version/--help probes run under ctx,
+// so a caller's timeout or cancellation bounds them instead of resolve
+// blocking forever on a binary that hangs when probed.
+func (f *RealCmdFactory) resolve(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	if resolved, ok := f.resolved[name]; ok {
+		f.mu.Unlock()
+		return resolved, nil
+	}
+	opts, hasOpts := f.registered[name]
+	f.mu.Unlock()
+
+	resolvedPath, _, err := lookPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	if hasOpts {
+		if len(opts.AllowedPaths) > 0 && !contains(opts.AllowedPaths, resolvedPath) {
+			return "", fmt.Errorf("%s resolved to %s, which is not in its configured allowlist %v", name, resolvedPath, opts.AllowedPaths)
+		}
+		if opts.MinVersion != "" {
+			if err := checkMinVersion(ctx, resolvedPath, opts.MinVersion); err != nil {
+				return "", fmt.Errorf("%s at %s: %s", name, resolvedPath, err)
+			}
+		}
+		if err := checkCapabilities(ctx, resolvedPath, opts.Capabilities); err != nil {
+			return "", fmt.Errorf("%s at %s: %s", name, resolvedPath, err)
+		}
+	}
+
+	f.mu.Lock()
+	if f.resolved == nil {
+		f.resolved = make(map[string]string)
+	}
+	f.resolved[name] = resolvedPath
+	f.mu.Unlock()
+	return resolvedPath, nil
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// lookPath resolves name on $PATH, like exec.LookPath, but also searches
+// the directory the agent binary lives in (and its bin/ subdir) so bundled
+// tools are found even if they're not on $PATH. searchDirs is returned for
+// use in NotFound error messages.
+func lookPath(name string) (resolvedPath string, searchDirs []string, err error) {
+	exe, exeErr := os.Executable()
+	if exeErr != nil {
+		exe = os.Args[0]
+	}
+	basepath := filepath.Dir(exe)
+
+	osPath := os.Getenv("PATH")
+	augmentedPath := basepath + string(filepath.ListSeparator) +
+		filepath.Join(basepath, "bin") + string(filepath.ListSeparator) + osPath
+	searchDirs = filepath.SplitList(augmentedPath)
+
+	os.Setenv("PATH", augmentedPath)
+	defer os.Setenv("PATH", osPath)
+
+	resolvedPath, err = exec.LookPath(name)
+	if err != nil {
+		return "", searchDirs, fmt.Errorf("%w: %s (searched %s)", ErrNotFound, name, strings.Join(searchDirs, string(filepath.ListSeparator)))
+	}
+	return resolvedPath, searchDirs, nil
+}
+
+// runProbe runs path with args (e.g. "--version"/"--help") for binary
+// resolution checks, returning its combined stdout+stderr. Like RunContext,
+// the probe runs in its own process group and, on ctx cancellation, kills
+// the whole group rather than just the probed process: a wrapper script
+// that forks a grandchild (e.g. one that keeps the probe's stdout pipe open
+// well past the script's own exit) would otherwise keep CombinedOutput from
+// returning even after the probed process is gone. WaitDelay bounds how
+// long Wait waits for those pipes to close before giving up on them.
+func runProbe(ctx context.Context, path string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = KillGracePeriod
+	return cmd.CombinedOutput()
+}
+
+var semverRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// semver is a parsed major.minor.patch version, comparable with compareSemver.
+type semver [3]int
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func parseSemver(s string) (semver, error) {
+	m := semverRe.FindStringSubmatch(s)
+	if m == nil {
+		return semver{}, fmt.Errorf("no version number found in %q", strings.TrimSpace(s))
+	}
+	var v semver
+	v[0], _ = strconv.Atoi(m[1])
+	v[1], _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v[2], _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+// compareSemver returns -1, 0, or 1 as a is less than, equal to, or
+// greater than b.
+func compareSemver(a, b semver) int {
+	for i := 0; i < 3; i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkMinVersion runs "path --version" and requires the version it
+// reports to be at least minVersion. The probe is bound by ctx so a binary
+// that hangs on --version can't block resolution forever.
+func checkMinVersion(ctx context.Context, path, minVersion string) error {
+	out, err := runProbe(ctx, path, "--version")
+	if err != nil {
+		return fmt.Errorf("running --version to check minimum version %s: %s", minVersion, err)
+	}
+	got, err := parseSemver(string(out))
+	if err != nil {
+		return fmt.Errorf("parsing --version output to check minimum version %s: %s", minVersion, err)
+	}
+	want, err := parseSemver(minVersion)
+	if err != nil {
+		return fmt.Errorf("invalid MinVersion %q: %s", minVersion, err)
+	}
+	if compareSemver(got, want) < 0 {
+		return fmt.Errorf("version %s is older than required minimum %s", got, minVersion)
+	}
+	return nil
+}
+
+// checkCapabilities runs "path --help" and requires each of caps to
+// appear (case-insensitively) in its output. The probe is bound by ctx so
+// a binary that hangs on --help can't block resolution forever.
+func checkCapabilities(ctx context.Context, path string, caps []string) error {
+	if len(caps) == 0 {
+		return nil
+	}
+	out, err := runProbe(ctx, path, "--help")
+	if err != nil {
+		return fmt.Errorf("running --help to check required capabilities: %s", err)
+	}
+	text := strings.ToLower(string(out))
+	for _, capability := range caps {
+		if !strings.Contains(text, strings.ToLower(capability)) {
+			return fmt.Errorf("missing required capability %q", capability)
+		}
+	}
+	return nil
 }
 
 type RealCmd struct {
 	Timeout time.Duration
+	// MaxOutputBytes caps how much of stdout and stderr is kept in memory,
+	// each independently. Zero means unlimited. Once a stream hits the cap,
+	// further writes are discarded and a truncation marker is appended so
+	// it's clear output was cut, not actually short.
+	MaxOutputBytes int64
+	// LineCallback, if set, is called with each line written to stdout or
+	// stderr (stream is "stdout" or "stderr") as it's produced, so
+	// long-running collectors can stream progress instead of waiting for
+	// the command to finish.
+	LineCallback func(stream, line string)
+	// Metrics, if set, receives a metrics.Sample for every invocation so
+	// operators can see per-binary duration histograms, exit codes, and
+	// timeout/kill counts instead of those only showing up as vague
+	// failures in the agent log.
+	Metrics *metrics.Collector
 	name    string
 	args    []string
+	ctx     context.Context
+	// factory resolves and caches name to an absolute path, validating it
+	// against any BinaryOpts registered for it. Set by RealCmdFactory.Make/
+	// MakeContext; if nil, RunContext falls back to resolving through
+	// Factory (if it's a *RealCmdFactory) so a RealCmd built any other way
+	// still goes through whatever allowlist/version/capability checks the
+	// agent registered, instead of silently skipping them.
+	factory *RealCmdFactory
+
+	stdoutRedirect *redirectSpec
+	stderrRedirect *redirectSpec
+	stdin          io.Reader
+	pipeOut        io.WriteCloser
+}
+
+// redirectSpec is a file an output stream should be written to, configured
+// via RedirectStdout/RedirectStderr/AppendStdout instead of shell-style
+// argv scanning.
+type redirectSpec struct {
+	path   string
+	append bool
+}
+
+// RedirectStdout sends the command's stdout to path, truncating it first.
+func (c *RealCmd) RedirectStdout(path string) {
+	c.stdoutRedirect = &redirectSpec{path: path}
+}
+
+// RedirectStderr sends the command's stderr to path, truncating it first.
+func (c *RealCmd) RedirectStderr(path string) {
+	c.stderrRedirect = &redirectSpec{path: path}
+}
+
+// AppendStdout sends the command's stdout to path, appending to it if it
+// already exists.
+func (c *RealCmd) AppendStdout(path string) {
+	c.stdoutRedirect = &redirectSpec{path: path, append: true}
+}
+
+// Pipe connects c's stdout to next's stdin and returns a Cmd that runs both
+// stages concurrently, like MakePipeline with two stages. next must be a
+// *RealCmd (e.g. made by RealCmdFactory.Make); if it isn't, the returned Cmd
+// fails with a descriptive error when run, rather than panicking here.
+func (c *RealCmd) Pipe(next Cmd) Cmd {
+	nextReal, ok := next.(*RealCmd)
+	if !ok {
+		return &erroringCmd{err: fmt.Errorf("Pipe: next is %T, not *RealCmd; only Cmds made by RealCmdFactory can be piped", next)}
+	}
+	return &pipelineCmd{stages: []*RealCmd{c, nextReal}}
+}
+
+// erroringCmd is a Cmd that always fails with err, used to turn a
+// programming mistake caught at Pipe/MakePipeline time (piping a Cmd that
+// isn't a *RealCmd) into a normal run-time error instead of a panic.
+type erroringCmd struct {
+	err error
+}
+
+func (e *erroringCmd) Run() (Result, error) {
+	return Result{}, e.err
+}
+
+func (e *erroringCmd) RunContext(ctx context.Context) (Result, error) {
+	return Result{}, e.err
 }
 
 type result struct {
-	output string
-	err    error
+	res Result
+	err error
+}
+
+// capWriter is an io.Writer that buffers up to max bytes (0 means
+// unlimited) and appends a truncation marker the first time it would
+// exceed that cap, instead of growing without bound.
+type capWriter struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (w *capWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.max <= 0 {
+		w.buf.Write(p)
+		return n, nil
+	}
+	if w.truncated {
+		return n, nil
+	}
+	remaining := w.max - int64(w.buf.Len())
+	if int64(len(p)) > remaining {
+		w.buf.Write(p[:remaining])
+		w.buf.WriteString("...[truncated, exceeded MaxOutputBytes]")
+		w.truncated = true
+		return n, nil
+	}
+	w.buf.Write(p)
+	return n, nil
+}
+
+// lineCallbackWriter tees writes to an underlying writer while also
+// invoking callback once per complete line, so streaming consumers see
+// output as it arrives rather than only after the command exits. partial
+// is capped at max bytes (0 means unlimited), the same as capWriter, so a
+// long run with no newline can't grow it without bound; once the cap is
+// hit no further lines are reported for this stream.
+type lineCallbackWriter struct {
+	stream     string
+	callback   func(stream, line string)
+	underlying io.Writer
+	max        int64
+	partial    []byte
+	truncated  bool
 }
 
-func NewRealCmd(name string, args ...string) *RealCmd {
+func (w *lineCallbackWriter) Write(p []byte) (int, error) {
+	n, err := w.underlying.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if !w.truncated {
+		if w.max <= 0 {
+			w.partial = append(w.partial, p...)
+		} else if room := w.max - int64(len(w.partial)); room > 0 {
+			if int64(len(p)) > room {
+				w.partial = append(w.partial, p[:room]...)
+				w.truncated = true
+			} else {
+				w.partial = append(w.partial, p...)
+			}
+		} else {
+			w.truncated = true
+		}
+	}
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		w.callback(w.stream, string(w.partial[:idx]))
+		w.partial = w.partial[idx+1:]
+	}
+	return n, nil
+}
+
+func newRealCmd(name string, args ...string) *RealCmd {
 	return &RealCmd{
 		name:    name,
 		args:    args,
@@ -78,91 +512,321 @@ func NewRealCmd(name string, args ...string) *RealCmd {
 	}
 }
 
-func (c *RealCmd) Run() (output string, err error) {
-	var basepath string
-	osPath := os.Getenv("PATH")
-	defer func() {
-		os.Setenv("PATH", osPath)
-	}()
+func (c *RealCmd) Run() (Result, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.RunContext(ctx)
+}
 
-	if binfile, err := os.Executable(); err != nil {
-		basepath = path.Dir(binfile)
-		os.Setenv("PATH", basepath+"/bin/"+string(filepath.ListSeparator)+osPath)
-	} else {
-		basepath = path.Dir(os.Args[0])
-		os.Setenv("PATH", basepath+string(filepath.ListSeparator)+osPath)
+// RunContext runs the command and blocks until it exits, the timeout
+// elapses, or ctx is done, whichever happens first. On timeout/cancellation
+// the process group is terminated gracefully: SIGTERM is sent first, and if
+// the process hasn't exited after KillGracePeriod, SIGKILL is sent to the
+// whole group so children spawned via shell redirection don't get orphaned.
+func (c *RealCmd) RunContext(ctx context.Context) (Result, error) {
+	// A stage that fails or returns before cmd.Start() owns reading its
+	// stdin; if that stdin is a pipeline stage's *io.PipeReader, close it
+	// so the upstream stage writing into the other end of the pipe isn't
+	// left blocked forever with no reader. Once Start succeeds, os/exec
+	// itself takes over reading c.stdin until the process exits.
+	started := false
+	if pr, ok := c.stdin.(*io.PipeReader); ok {
+		defer func() {
+			if !started {
+				pr.Close()
+			}
+		}()
 	}
 
-	// Redirection using > is a shell/bash feature, not part of a command
-	// Here we try to detect output redirection and if there is a redirection,
-	// we need to create the output file and set cmd.Stout to that file
-	args := []string{}
-	outFilename := ""
-	var outfile *os.File
+	// Binary resolution (including any --version/--help probes) is bound by
+	// ctx and c.Timeout just like running the command itself, so a binary
+	// that hangs while being resolved can't block RunContext forever.
+	resolveCtx := ctx
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		resolveCtx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
 
-	for _, arg := range c.args {
-		if strings.HasPrefix(arg, ">") {
-			outFilename = strings.TrimSpace(strings.TrimPrefix(arg, ">"))
-			break
+	var binPath string
+	var err error
+	switch {
+	case c.factory != nil:
+		binPath, err = c.factory.resolve(resolveCtx, c.name)
+	case Factory != nil:
+		// c wasn't built via a RealCmdFactory (e.g. a bare &RealCmd{}
+		// literal), but the agent's real factory is still reachable
+		// through Factory, so resolve through it rather than falling
+		// back to an unvalidated exec.LookPath.
+		if rf, ok := Factory.(*RealCmdFactory); ok {
+			binPath, err = rf.resolve(resolveCtx, c.name)
+		} else {
+			binPath, _, err = lookPath(c.name)
 		}
-		args = append(args, arg)
+	default:
+		binPath, _, err = lookPath(c.name)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	// args are passed to exec.Command verbatim: no shell-style scanning for
+	// redirection or anything else. Use RedirectStdout/RedirectStderr/
+	// AppendStdout/Pipe to set those up explicitly instead.
+	cmd := exec.Command(binPath, c.args...)
+	// Run the child in its own process group so a timeout/cancellation can
+	// terminate it and anything it spawned (e.g. via shell redirection)
+	// instead of leaving orphans behind.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if c.stdin != nil {
+		cmd.Stdin = c.stdin
+	}
+
+	stdoutCap := &capWriter{max: c.MaxOutputBytes}
+	stderrCap := &capWriter{max: c.MaxOutputBytes}
+	var cmdStdout, cmdStderr io.Writer = stdoutCap, stderrCap
+	if c.LineCallback != nil {
+		cmdStdout = &lineCallbackWriter{stream: "stdout", callback: c.LineCallback, underlying: stdoutCap, max: c.MaxOutputBytes}
+		cmdStderr = &lineCallbackWriter{stream: "stderr", callback: c.LineCallback, underlying: stderrCap, max: c.MaxOutputBytes}
+	}
+	if c.pipeOut != nil {
+		cmdStdout = io.MultiWriter(cmdStdout, c.pipeOut)
+		defer c.pipeOut.Close()
 	}
-	cmd := exec.Command(c.name, args...)
-	if outFilename != "" {
-		outfile, err = os.Create(outFilename)
+	cmd.Stdout = cmdStdout
+	cmd.Stderr = cmdStderr
+
+	if c.stdoutRedirect != nil {
+		outfile, err := openRedirect(c.stdoutRedirect)
 		if err != nil {
-			return "", err
+			return Result{}, err
 		}
 		defer outfile.Close()
-		cmd.Stdout = outfile
+		if c.pipeOut != nil {
+			// Redirecting stdout to a file shouldn't silently cut off a
+			// piped next stage: write to both instead of dropping pipeOut.
+			cmd.Stdout = io.MultiWriter(outfile, c.pipeOut)
+		} else {
+			cmd.Stdout = outfile
+		}
+	}
+	if c.stderrRedirect != nil {
+		errfile, err := openRedirect(c.stderrRedirect)
+		if err != nil {
+			return Result{}, err
+		}
+		defer errfile.Close()
+		cmd.Stderr = errfile
 	}
 	// Workaround for "HOME: parameter not set"
 	if os.Getenv("HOME") == "" {
 		cmd.Env = append(os.Environ(), "HOME=/root")
 	}
 
-	resultChan := runCmd(cmd, outFilename)
+	// Start synchronously so cmd.Process is set before killProcessGroup (run
+	// from this goroutine, concurrently with the Wait below) ever reads it;
+	// otherwise it races os/exec.(*Cmd).Start writing cmd.Process.
+	if err := cmd.Start(); err != nil {
+		if execError, ok := err.(*exec.Error); ok && execError.Err == exec.ErrNotFound {
+			return Result{}, ErrNotFound
+		}
+		return Result{}, err
+	}
+	started = true
+
+	start := time.Now()
+	resultChan := runCmd(cmd, stdoutCap, stderrCap, start)
 	select {
 	case <-time.After(c.Timeout):
-		killErr := cmd.Process.Kill()
-		if killErr != nil {
-			// @todo:
-			// If this happens that means leaving working process,
-			// plus working goroutine waiting for that process to finish.
-			// And since this command is going to be run over, and over again
-			// we might end up with hundreds processes and goroutines hanging.
-			// Maybe in such critical cases (or after n-cases) we should shutdown whole module (e.g. qan/mm/summary)
-			// and notify us (developers), because this shouldn't happen in correct working program - but you never know
-			return "", ErrKillProcessAfterTimeout
-		}
-		return "", ErrTimeout
+		res, err, killed := c.killProcessGroup(cmd, resultChan, ErrTimeout)
+		c.recordMetrics(cmd, res, start, true, killed)
+		return res, err
+	case <-ctx.Done():
+		res, err, killed := c.killProcessGroup(cmd, resultChan, ctx.Err())
+		c.recordMetrics(cmd, res, start, false, killed)
+		return res, err
 	case result := <-resultChan:
-		execError, ok := result.err.(*exec.Error)
-		if ok && execError.Err == exec.ErrNotFound {
-			return "", ErrNotFound
+		c.recordMetrics(cmd, result.res, start, false, false)
+		return result.res, result.err
+	}
+}
+
+// recordMetrics reports one invocation to c.Metrics, if set. It's a no-op
+// otherwise, so instrumentation is opt-in and doesn't cost anything for
+// callers that don't set Metrics.
+func (c *RealCmd) recordMetrics(cmd *exec.Cmd, res Result, start time.Time, timedOut, killedAfterTimeout bool) {
+	if c.Metrics == nil {
+		return
+	}
+	var userTime, sysTime time.Duration
+	var maxRSS int64
+	if ps := cmd.ProcessState; ps != nil {
+		userTime = ps.UserTime()
+		sysTime = ps.SystemTime()
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			maxRSS = ru.Maxrss
+		}
+	}
+	c.Metrics.Observe(metrics.Sample{
+		Binary:             c.name,
+		Duration:           time.Since(start),
+		UserTime:           userTime,
+		SysTime:            sysTime,
+		MaxRSS:             maxRSS,
+		ExitCode:           res.ExitCode,
+		TimedOut:           timedOut,
+		KilledAfterTimeout: killedAfterTimeout,
+	})
+}
+
+// openRedirect opens the file backing a redirectSpec, truncating or
+// appending as configured.
+func openRedirect(r *redirectSpec) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if r.append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(r.path, flags, 0644)
+}
+
+// killProcessGroup terminates cmd's process group after a timeout or context
+// cancellation: SIGTERM first, then SIGKILL if the group hasn't exited within
+// KillGracePeriod (reported via the killed return value). It returns the
+// Result captured before the process was killed (if any) and cause, unless
+// the group couldn't be killed at all or its exit wasn't confirmed within
+// KillConfirmTimeout, in which case it returns ErrKillProcessAfterTimeout so
+// the caller knows a process may have leaked.
+func (c *RealCmd) killProcessGroup(cmd *exec.Cmd, resultChan chan result, cause error) (res Result, err error, killed bool) {
+	pgid, pgErr := syscall.Getpgid(cmd.Process.Pid)
+	if pgErr != nil {
+		if killErr := cmd.Process.Kill(); killErr != nil {
+			return Result{}, ErrKillProcessAfterTimeout, false
+		}
+		if res, ok := waitForResult(resultChan); ok {
+			return res, cause, false
+		}
+		return Result{}, ErrKillProcessAfterTimeout, false
+	}
+
+	if termErr := syscall.Kill(-pgid, syscall.SIGTERM); termErr != nil {
+		if killErr := cmd.Process.Kill(); killErr != nil {
+			return Result{}, ErrKillProcessAfterTimeout, false
+		}
+		if res, ok := waitForResult(resultChan); ok {
+			return res, cause, false
+		}
+		return Result{}, ErrKillProcessAfterTimeout, false
+	}
+
+	select {
+	case r := <-resultChan:
+		return r.res, cause, false
+	case <-time.After(KillGracePeriod):
+		if killErr := syscall.Kill(-pgid, syscall.SIGKILL); killErr != nil {
+			return Result{}, ErrKillProcessAfterTimeout, true
+		}
+		// Wait for Wait() to actually reap the process instead of
+		// returning as soon as the signal is sent, so the Result and
+		// metrics recorded for this invocation reflect a process that's
+		// confirmed dead, not one still exiting. Bounded by
+		// KillConfirmTimeout: Wait() itself can still be stuck flushing a
+		// piped stage's stdout into a downstream stage that never reads it,
+		// and a dead process must not leave RunContext hung forever.
+		if res, ok := waitForResult(resultChan); ok {
+			return res, cause, true
 		}
-		return result.output, result.err
+		return Result{}, ErrKillProcessAfterTimeout, true
 	}
 }
 
-func runCmd(cmd *exec.Cmd, redirectFile string) (resultChan chan result) {
+// waitForResult waits for resultChan to produce a result, up to
+// KillConfirmTimeout, returning ok=false if it times out.
+func waitForResult(resultChan chan result) (Result, bool) {
+	select {
+	case r := <-resultChan:
+		return r.res, true
+	case <-time.After(KillConfirmTimeout):
+		return Result{}, false
+	}
+}
+
+// runCmd waits for an already-started cmd to finish in a goroutine, reading
+// its captured stdout/stderr out of stdoutCap/stderrCap once it exits. The
+// caller must have called cmd.Start (not cmd.Run) before calling runCmd, so
+// cmd.Process is already set and can't race with this goroutine's Wait.
+func runCmd(cmd *exec.Cmd, stdoutCap, stderrCap *capWriter, start time.Time) (resultChan chan result) {
 	// Below channels has buffer
 	// because we might get data before we would be waiting on this channel
 	resultChan = make(chan result, 1)
 	go func() {
-		var output []byte
-		var err error
+		err := cmd.Wait()
+		duration := time.Since(start)
 
-		if redirectFile == "" {
-			output, err = cmd.CombinedOutput()
-		} else {
-			output = []byte(redirectFile)
-			err = cmd.Run()
+		exitCode := 0
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+
+		res := Result{
+			Stdout:   stdoutCap.buf.String(),
+			Stderr:   stderrCap.buf.String(),
+			ExitCode: exitCode,
+			Duration: duration,
 		}
 		select {
-		case resultChan <- result{output: string(output), err: err}:
+		case resultChan <- result{res: res, err: err}:
 		default:
 		}
 	}()
 	return resultChan
 }
+
+// pipelineCmd runs a sequence of *RealCmd stages concurrently, with each
+// stage's stdout feeding the next stage's stdin over an io.Pipe, mirroring
+// a shell pipeline without invoking a shell. Run/RunContext return the
+// last stage's Result; the first error from any stage (in stage order)
+// is returned, not just the last stage's.
+type pipelineCmd struct {
+	stages []*RealCmd
+}
+
+func (p *pipelineCmd) Run() (Result, error) {
+	return p.RunContext(context.Background())
+}
+
+func (p *pipelineCmd) RunContext(ctx context.Context) (Result, error) {
+	n := len(p.stages)
+	readers := make([]*io.PipeReader, n-1)
+	for i := 0; i < n-1; i++ {
+		pr, pw := io.Pipe()
+		readers[i] = pr
+		p.stages[i].pipeOut = pw
+	}
+	for i := 1; i < n; i++ {
+		p.stages[i].stdin = readers[i-1]
+	}
+
+	results := make([]Result, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, stage := range p.stages {
+		wg.Add(1)
+		go func(i int, stage *RealCmd) {
+			defer wg.Done()
+			results[i], errs[i] = stage.RunContext(ctx)
+		}(i, stage)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return results[n-1], err
+		}
+	}
+	return results[n-1], nil
+}
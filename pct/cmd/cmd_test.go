@@ -0,0 +1,441 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunEcho(t *testing.T) {
+	res, err := newRealCmd("echo", "hello").Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if strings.TrimSpace(res.Stdout) != "hello" {
+		t.Errorf("Stdout = %q, want %q", res.Stdout, "hello")
+	}
+	if res.ExitCode != 0 {
+		t.Errorf("ExitCode = %d, want 0", res.ExitCode)
+	}
+}
+
+func TestRunContextTimeoutKillsProcessGroup(t *testing.T) {
+	c := newRealCmd("sh", "-c", "sleep 5")
+	c.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Run()
+	elapsed := time.Since(start)
+
+	if err != ErrTimeout {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+	// KillGracePeriod should bound how long a timed-out command can take to
+	// actually finish; if the signals reached only sh and not the sleep it
+	// runs, Wait would block on the still-open stdout pipe for the full 5s
+	// sleep instead.
+	if elapsed >= KillGracePeriod+2*time.Second {
+		t.Errorf("took %v to return after timeout, want well under the sleep duration", elapsed)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	c := newRealCmd("sleep", "5")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := c.RunContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestFactoryRegisterAllowlist(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("echo", BinaryOpts{AllowedPaths: []string{"/nonexistent/echo"}})
+
+	if _, err := f.Make("echo", "hi").Run(); err == nil {
+		t.Fatal("expected allowlist rejection, got nil error")
+	}
+}
+
+func TestBareRealCmdIsValidatedAgainstFactory(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("echo", BinaryOpts{AllowedPaths: []string{"/nonexistent/echo"}})
+
+	prevFactory := Factory
+	Factory = f
+	defer func() { Factory = prevFactory }()
+
+	// Constructing a RealCmd any way other than through f.Make must still
+	// be checked against f's registered opts, not silently skip them.
+	c := &RealCmd{Timeout: DefaultTimeout, name: "echo", args: []string{"hi"}}
+	if _, err := c.Run(); err == nil {
+		t.Fatal("expected allowlist rejection for a bare *RealCmd, got nil error")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	f := &RealCmdFactory{}
+	echoCmd := f.Make("echo", "hello world")
+	grepCmd := f.Make("grep", "world")
+
+	res, err := echoCmd.(*RealCmd).Pipe(grepCmd).Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.Contains(res.Stdout, "world") {
+		t.Errorf("Stdout = %q, want it to contain %q", res.Stdout, "world")
+	}
+}
+
+type fakeCmd struct{}
+
+func (fakeCmd) Run() (Result, error)                           { return Result{}, nil }
+func (fakeCmd) RunContext(ctx context.Context) (Result, error) { return Result{}, nil }
+
+func TestPipeRejectsNonRealCmd(t *testing.T) {
+	f := &RealCmdFactory{}
+	echoCmd := f.Make("echo", "hi").(*RealCmd)
+
+	_, err := echoCmd.Pipe(fakeCmd{}).Run()
+	if err == nil {
+		t.Fatal("expected an error piping a non-*RealCmd stage, got nil")
+	}
+}
+
+func TestMakePipelineRejectsNonRealCmd(t *testing.T) {
+	f := &RealCmdFactory{}
+
+	_, err := f.MakePipeline(f.Make("echo", "hi"), fakeCmd{}).Run()
+	if err == nil {
+		t.Fatal("expected an error for a pipeline containing a non-*RealCmd stage, got nil")
+	}
+}
+
+func TestPipelineDoesNotDeadlockWhenDownstreamStageFailsToStart(t *testing.T) {
+	f := &RealCmdFactory{}
+	stage0 := f.Make("sh", "-c", `trap '' TERM; while true; do echo spin; done`).(*RealCmd)
+	stage0.Timeout = 50 * time.Millisecond
+	stage1 := f.Make("this-binary-definitely-does-not-exist-xyz")
+
+	pipeline := f.MakePipeline(stage0, stage1)
+
+	done := make(chan struct{})
+	go func() {
+		pipeline.Run()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline.Run() did not return: stage0's blocked stdout write and stage1's early failure deadlocked")
+	}
+}
+
+func TestMaxOutputBytesTruncatesStdoutAndStderr(t *testing.T) {
+	c := newRealCmd("sh", "-c", "printf '0123456789'; printf '0123456789' >&2")
+	c.MaxOutputBytes = 4
+
+	res, err := c.Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.HasPrefix(res.Stdout, "0123") || !strings.Contains(res.Stdout, "truncated") {
+		t.Errorf("Stdout = %q, want it capped at 4 bytes with a truncation marker", res.Stdout)
+	}
+	if !strings.HasPrefix(res.Stderr, "0123") || !strings.Contains(res.Stderr, "truncated") {
+		t.Errorf("Stderr = %q, want it capped at 4 bytes with a truncation marker", res.Stderr)
+	}
+}
+
+func TestResultCapturesStderrSeparately(t *testing.T) {
+	res, err := newRealCmd("sh", "-c", "echo out; echo err >&2").Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if strings.TrimSpace(res.Stdout) != "out" {
+		t.Errorf("Stdout = %q, want %q", res.Stdout, "out")
+	}
+	if strings.TrimSpace(res.Stderr) != "err" {
+		t.Errorf("Stderr = %q, want %q", res.Stderr, "err")
+	}
+}
+
+func TestLineCallbackReceivesCompleteLines(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+
+	c := newRealCmd("sh", "-c", `printf 'one\ntwo\n'`)
+	c.LineCallback = func(stream, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, stream+":"+line)
+	}
+	if _, err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"stdout:one", "stdout:two"}
+	if len(lines) != len(want) {
+		t.Fatalf("got lines %v, want %v", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestLineCallbackWriterSplitsLines(t *testing.T) {
+	var got []string
+	w := &lineCallbackWriter{
+		callback:   func(stream, line string) { got = append(got, line) },
+		underlying: &capWriter{},
+	}
+	if _, err := w.Write([]byte("a\nb\nc")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	want := []string{"a", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("got lines %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLineCallbackWriterCapsPartialBuffer(t *testing.T) {
+	w := &lineCallbackWriter{
+		callback:   func(stream, line string) {},
+		underlying: &capWriter{},
+		max:        10,
+	}
+
+	if _, err := w.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if len(w.partial) > 10 {
+		t.Fatalf("partial grew to %d bytes, want it capped at max=10", len(w.partial))
+	}
+
+	// Once capped, further writes (even ones containing a newline) must not
+	// grow partial past the cap.
+	if _, err := w.Write([]byte("more\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if len(w.partial) > 10 {
+		t.Errorf("partial grew to %d bytes after a later write, want it to stay capped at max=10", len(w.partial))
+	}
+}
+
+func TestRedirectStdoutTruncatesAndAppendStdoutAppends(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt")
+
+	c := newRealCmd("sh", "-c", "echo first")
+	c.RedirectStdout(path)
+	if _, err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	c2 := newRealCmd("sh", "-c", "echo second")
+	c2.AppendStdout(path)
+	if _, err := c2.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if want := "first\nsecond\n"; string(got) != want {
+		t.Errorf("file contents = %q, want %q", got, want)
+	}
+}
+
+func TestRedirectStderr(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "err.txt")
+
+	c := newRealCmd("sh", "-c", "echo oops >&2")
+	c.RedirectStderr(path)
+	if _, err := c.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if strings.TrimSpace(string(got)) != "oops" {
+		t.Errorf("file contents = %q, want %q", got, "oops")
+	}
+}
+
+func TestRedirectStdoutComposesWithPipedStage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt")
+
+	f := &RealCmdFactory{}
+	echoCmd := f.Make("sh", "-c", "echo hello").(*RealCmd)
+	echoCmd.RedirectStdout(path)
+	grepCmd := f.Make("grep", "hello")
+
+	res, err := echoCmd.Pipe(grepCmd).Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.Contains(res.Stdout, "hello") {
+		t.Errorf("piped stage Stdout = %q, want it to contain %q", res.Stdout, "hello")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if strings.TrimSpace(string(got)) != "hello" {
+		t.Errorf("redirect file contents = %q, want %q; redirecting stdout must not silently drop the piped stage's input", got, "hello")
+	}
+}
+
+func TestBinaryOptsMinVersionRejectsTooOld(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("echo", BinaryOpts{MinVersion: "999.0.0"})
+
+	if _, err := f.Make("echo", "hi").Run(); err == nil {
+		t.Fatal("expected MinVersion rejection, got nil error")
+	}
+}
+
+func TestBinaryOptsMinVersionAcceptsNewEnough(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("echo", BinaryOpts{MinVersion: "1.0.0"})
+
+	res, err := f.Make("echo", "hi").Run()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if strings.TrimSpace(res.Stdout) != "hi" {
+		t.Errorf("Stdout = %q, want %q", res.Stdout, "hi")
+	}
+}
+
+func TestBinaryOptsCapabilitiesRejectsMissing(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("grep", BinaryOpts{Capabilities: []string{"this capability does not exist in grep --help"}})
+
+	if _, err := f.Make("grep", "--version").Run(); err == nil {
+		t.Fatal("expected capability rejection, got nil error")
+	}
+}
+
+func TestBinaryOptsCapabilitiesAcceptsPresent(t *testing.T) {
+	f := &RealCmdFactory{}
+	f.Register("grep", BinaryOpts{Capabilities: []string{"pattern"}})
+
+	if _, err := f.Make("grep", "--version").Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+}
+
+func TestErrNotFoundMessageIncludesSearchedDirectories(t *testing.T) {
+	_, _, err := lookPath("this-binary-definitely-does-not-exist-xyz")
+	if err == nil {
+		t.Fatal("expected lookPath to fail for a nonexistent binary")
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want it to wrap ErrNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "searched") {
+		t.Errorf("err = %v, want it to mention the directories searched", err)
+	}
+}
+
+func TestResolveRespectsContextAndTimeout(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "slow-version")
+	contents := "#!/bin/sh\nif [ \"$1\" = \"--version\" ]; then sleep 5; fi\necho 1.0.0\n"
+	if err := os.WriteFile(script, []byte(contents), 0755); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	f := &RealCmdFactory{}
+	f.Register("slow-version", BinaryOpts{MinVersion: "1.0.0"})
+
+	c := f.Make("slow-version").(*RealCmd)
+	c.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Run()
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected an error from a --version probe that outlives c.Timeout")
+	}
+	// Without binding the probe to c.Timeout, this would take the script's
+	// full 5s sleep to return.
+	if elapsed >= 2*time.Second {
+		t.Errorf("took %v to return, want well under the slow-version script's 5s sleep", elapsed)
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.4", "1.2.3", 1},
+		{"1.2.2", "1.2.3", -1},
+		{"2.0", "1.9.9", 1},
+	}
+	for _, tc := range cases {
+		a, err := parseSemver(tc.a)
+		if err != nil {
+			t.Fatalf("parseSemver(%q) error = %v", tc.a, err)
+		}
+		b, err := parseSemver(tc.b)
+		if err != nil {
+			t.Fatalf("parseSemver(%q) error = %v", tc.b, err)
+		}
+		if got := compareSemver(a, b); got != tc.want {
+			t.Errorf("compareSemver(%s, %s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package metrics collects per-invocation process metrics from pct/cmd and
+// exposes them in Prometheus text exposition format, so qan-agent services
+// (and the Percona backend, via qan-agent's own metric shipping) can see
+// things like "pt-mysql-summary regressed from p50=2s to p50=30s" instead
+// of that only showing up as a vague timeout.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sample is one Cmd invocation's measurements, handed to a Collector after
+// the command finishes (however it finishes: success, non-zero exit,
+// timeout, or kill-after-timeout).
+type Sample struct {
+	Binary             string
+	Duration           time.Duration
+	UserTime           time.Duration
+	SysTime            time.Duration
+	MaxRSS             int64 // kilobytes, per getrusage(2); see ru_maxrss
+	ExitCode           int
+	TimedOut           bool
+	KilledAfterTimeout bool
+}
+
+// historySize is how many recent durations each binary's rolling
+// histogram keeps. It bounds memory use per binary regardless of how long
+// the agent has been running.
+const historySize = 256
+
+// Collector aggregates Samples per binary name. It's safe for concurrent
+// use by multiple Cmds running at once.
+type Collector struct {
+	mu    sync.Mutex
+	stats map[string]*binaryStats
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{stats: make(map[string]*binaryStats)}
+}
+
+type binaryStats struct {
+	runs               uint64
+	timeouts           uint64
+	killedAfterTimeout uint64
+	durationsMs        *rollingHistogram
+}
+
+// Observe records one Sample. Binary is typically the command name (e.g.
+// "pt-mysql-summary"), not the full resolved path, so samples for the same
+// logical tool aggregate together even if it's resolved from different
+// paths over the agent's lifetime.
+func (c *Collector) Observe(s Sample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bs, ok := c.stats[s.Binary]
+	if !ok {
+		bs = &binaryStats{durationsMs: newRollingHistogram(historySize)}
+		c.stats[s.Binary] = bs
+	}
+	bs.runs++
+	if s.TimedOut {
+		bs.timeouts++
+	}
+	if s.KilledAfterTimeout {
+		bs.killedAfterTimeout++
+	}
+	bs.durationsMs.add(float64(s.Duration.Milliseconds()))
+}
+
+// quantiles reported in the exposition output, e.g. p50/p90/p99.
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+// statSnapshot is a point-in-time copy of one binary's stats, taken while
+// holding Collector.mu, so WriteTo can format output after unlocking without
+// racing a concurrent Observe mutating the same binaryStats/rollingHistogram.
+type statSnapshot struct {
+	runs               uint64
+	timeouts           uint64
+	killedAfterTimeout uint64
+	quantiles          map[float64]float64
+}
+
+// WriteTo writes all collected metrics to w in Prometheus text exposition
+// format. It implements io.WriterTo.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.stats))
+	snapshots := make(map[string]statSnapshot, len(c.stats))
+	for name, bs := range c.stats {
+		names = append(names, name)
+		qs := make(map[float64]float64, len(quantiles))
+		for _, q := range quantiles {
+			qs[q] = bs.durationsMs.quantile(q)
+		}
+		snapshots[name] = statSnapshot{
+			runs:               bs.runs,
+			timeouts:           bs.timeouts,
+			killedAfterTimeout: bs.killedAfterTimeout,
+			quantiles:          qs,
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(names)
+
+	cw := &countingWriter{w: w}
+
+	fmt.Fprintln(cw, "# HELP qan_agent_cmd_duration_milliseconds Rolling quantiles of command duration, in milliseconds.")
+	fmt.Fprintln(cw, "# TYPE qan_agent_cmd_duration_milliseconds summary")
+	for _, name := range names {
+		for _, q := range quantiles {
+			fmt.Fprintf(cw, "qan_agent_cmd_duration_milliseconds{binary=%q,quantile=\"%g\"} %g\n", name, q, snapshots[name].quantiles[q])
+		}
+	}
+
+	fmt.Fprintln(cw, "# HELP qan_agent_cmd_runs_total Total number of times a command was run.")
+	fmt.Fprintln(cw, "# TYPE qan_agent_cmd_runs_total counter")
+	for _, name := range names {
+		fmt.Fprintf(cw, "qan_agent_cmd_runs_total{binary=%q} %d\n", name, snapshots[name].runs)
+	}
+
+	fmt.Fprintln(cw, "# HELP qan_agent_cmd_timeouts_total Total number of times a command hit its timeout.")
+	fmt.Fprintln(cw, "# TYPE qan_agent_cmd_timeouts_total counter")
+	for _, name := range names {
+		fmt.Fprintf(cw, "qan_agent_cmd_timeouts_total{binary=%q} %d\n", name, snapshots[name].timeouts)
+	}
+
+	fmt.Fprintln(cw, "# HELP qan_agent_cmd_killed_after_timeout_total Total number of times a command had to be killed because it didn't exit after SIGTERM.")
+	fmt.Fprintln(cw, "# TYPE qan_agent_cmd_killed_after_timeout_total counter")
+	for _, name := range names {
+		fmt.Fprintf(cw, "qan_agent_cmd_killed_after_timeout_total{binary=%q} %d\n", name, snapshots[name].killedAfterTimeout)
+	}
+
+	return cw.n, cw.err
+}
+
+// countingWriter tracks bytes written and the first error seen, so
+// WriteTo can satisfy io.WriterTo without checking every Fprint* call.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// rollingHistogram keeps the last N observations and answers quantile
+// queries over them. It's not exact (observations outside the window are
+// forgotten) but that's the point: it tracks recent behavior, e.g. "p50
+// over the last 256 runs", not an all-time average that a regression
+// would take forever to show up in.
+type rollingHistogram struct {
+	samples []float64
+	next    int
+	filled  bool
+}
+
+func newRollingHistogram(capacity int) *rollingHistogram {
+	return &rollingHistogram{samples: make([]float64, capacity)}
+}
+
+func (h *rollingHistogram) add(v float64) {
+	h.samples[h.next] = v
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.filled = true
+	}
+}
+
+func (h *rollingHistogram) quantile(q float64) float64 {
+	n := h.next
+	if h.filled {
+		n = len(h.samples)
+	}
+	if n == 0 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, h.samples[:n])
+	sort.Float64s(sorted)
+
+	idx := int(q * float64(n-1))
+	return sorted[idx]
+}
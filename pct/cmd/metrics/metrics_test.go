@@ -0,0 +1,92 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserveAndWriteTo(t *testing.T) {
+	c := NewCollector()
+	c.Observe(Sample{Binary: "pt-summary", Duration: 10 * time.Millisecond})
+	c.Observe(Sample{Binary: "pt-summary", Duration: 20 * time.Millisecond, TimedOut: true})
+	c.Observe(Sample{Binary: "pt-summary", Duration: 30 * time.Millisecond, KilledAfterTimeout: true})
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		`qan_agent_cmd_runs_total{binary="pt-summary"} 3`,
+		`qan_agent_cmd_timeouts_total{binary="pt-summary"} 1`,
+		`qan_agent_cmd_killed_after_timeout_total{binary="pt-summary"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRollingHistogramQuantile(t *testing.T) {
+	h := newRollingHistogram(4)
+	for _, v := range []float64{1, 2, 3, 4} {
+		h.add(v)
+	}
+	if got := h.quantile(0.5); got != 2 {
+		t.Errorf("quantile(0.5) = %v, want 2", got)
+	}
+}
+
+// TestConcurrentObserveAndWriteTo exercises Observe and WriteTo from separate
+// goroutines at the same time. It doesn't assert on the output, but run with
+// `go test -race` it catches WriteTo reading a rollingHistogram after
+// Collector.mu was released while Observe concurrently mutates it.
+func TestConcurrentObserveAndWriteTo(t *testing.T) {
+	c := NewCollector()
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c.Observe(Sample{Binary: "x", Duration: time.Duration(i) * time.Millisecond})
+		}
+		close(done)
+	}()
+	go func() {
+		defer wg.Done()
+		var buf bytes.Buffer
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				buf.Reset()
+				c.WriteTo(&buf)
+			}
+		}
+	}()
+	wg.Wait()
+}